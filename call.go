@@ -0,0 +1,142 @@
+package coms
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/seanlee0923/coms/logger"
+	"github.com/seanlee0923/coms/protocol"
+)
+
+// ErrTimeout is returned when a Call's deadline elapses before a response
+// arrives.
+var ErrTimeout = errors.New("coms: call timeout")
+
+type callConfig struct {
+	timeout time.Duration
+	replay  bool
+	meta    map[string]string
+}
+
+// CallOption customizes a single CallContext invocation.
+type CallOption func(*callConfig)
+
+// WithTimeout overrides the client's default read timeout for this call.
+func WithTimeout(d time.Duration) CallOption {
+	return func(cfg *callConfig) {
+		cfg.timeout = d
+	}
+}
+
+// WithReplay marks the call idempotent: if the connection drops while it is
+// in flight, it is re-sent on the next connection (see NewDialClient)
+// instead of failing with ErrDisconnected.
+func WithReplay() CallOption {
+	return func(cfg *callConfig) {
+		cfg.replay = true
+	}
+}
+
+// WithMeta attaches a metadata key/value pair that is marshalled onto the
+// outgoing protocol.Message.
+func WithMeta(key, value string) CallOption {
+	return func(cfg *callConfig) {
+		if cfg.meta == nil {
+			cfg.meta = make(map[string]string)
+		}
+		cfg.meta[key] = value
+	}
+}
+
+// Call is CallContext with context.Background() and no options.
+func (c *Client) Call(action string, data any) (*protocol.Message, error) {
+	return c.CallContext(context.Background(), action, data)
+}
+
+// CallContext sends action/data to the peer and waits for its response. The
+// call is aborted if ctx is cancelled before a response arrives, in which
+// case a protocol.Cancel frame is sent so the peer can give up on the
+// request, and ctx.Err() is returned.
+func (c *Client) CallContext(ctx context.Context, action string, data any, opts ...CallOption) (*protocol.Message, error) {
+
+	cfg := callConfig{timeout: c.timeout.ReadWait}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	// A zero limit, as on a client from NewDialClient, means no limit.
+	if c.maxPendingCalls > 0 && c.pendingCnt.Load() >= int32(c.maxPendingCalls) {
+		return nil, errors.New("max pending calls exceeded")
+	}
+
+	raw, err := c.activeCodec().Marshal(data)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
+	req := &protocol.Message{
+		Id:     uuid.NewString(),
+		Type:   protocol.Req,
+		Action: action,
+		Data:   raw,
+		Meta:   cfg.meta,
+	}
+
+	entry := &pendingEntry{req: req, respCh: make(chan callResult, 1), replay: cfg.replay}
+	c.pendingCalls.Store(req.Id, entry)
+	c.pendingCnt.Add(1)
+	defer func() {
+		c.pendingCalls.Delete(req.Id)
+		c.pendingCnt.Add(-1)
+	}()
+
+	msgBytes, err := req.ToBytes()
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
+	logger.Info(string(msgBytes))
+
+	if err := c.enqueue(msgBytes, PriorityNormal); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(cfg.timeout)
+	defer timer.Stop()
+
+	select {
+
+	case result := <-entry.respCh:
+		logger.InfoF("resp : %v", result.msg)
+		return result.msg, result.err
+
+	case <-ctx.Done():
+		c.sendCancel(req.Id)
+		return nil, ctx.Err()
+
+	case <-timer.C:
+		return nil, ErrTimeout
+
+	}
+
+}
+
+// sendCancel tells the peer to abort the in-flight handler for id. It is
+// best-effort: if the control queue is full the frame is dropped rather
+// than blocking the caller further.
+func (c *Client) sendCancel(id string) {
+	cancel := &protocol.Message{Id: id, Type: protocol.Cancel}
+	msgBytes, err := cancel.ToBytes()
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	if err := c.enqueue(msgBytes, PriorityControl); err != nil {
+		logger.Error(err)
+	}
+}
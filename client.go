@@ -1,15 +1,16 @@
 package coms
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/seanlee0923/coms/logger"
 	"github.com/seanlee0923/coms/protocol"
-	"sync"
-	"sync/atomic"
-	"time"
 )
 
 func init() {
@@ -21,33 +22,80 @@ type Client struct {
 	conn    *websocket.Conn
 	timeout protocol.TimeOutConfig
 
-	handler map[string]Handler
+	hub        WebSocketInstance
+	handler    map[string]Handler
+	middleware []Middleware
+	codec      Codec
+
+	// url/dial are only set for clients created with NewDialClient; they
+	// carry the information Run needs to (re)establish the connection.
+	url  string
+	dial *DialOptions
 
-	pingCh     chan []byte
-	messageIn  chan []byte
-	messageOut chan []byte
-	closeCh    chan bool
+	pingCh    chan []byte
+	messageIn chan []byte
+
+	// outNormal/outControl are the bounded outbound queues writeLoop
+	// drains; control-priority frames (such as cancel) are served ahead of
+	// normal traffic. Use enqueue to write to them.
+	outNormal  chan []byte
+	outControl chan []byte
+
+	// closeCh is closed exactly once, when the connection starts shutting
+	// down, so any number of goroutines can select on it without racing to
+	// consume a single value the way a buffered channel send would.
+	closeCh   chan struct{}
+	closeOnce sync.Once
 
 	connected bool
+	lastErr   error
+	closeCode int
 
 	pendingCalls    sync.Map
 	pendingCnt      atomic.Int32
 	maxPendingCalls int
 
+	// pendingSubs maps a Subscribe request id to its *Subscription so
+	// readLoop can route protocol.Stream frames to the right subscriber.
+	pendingSubs sync.Map
+
+	// inFlight maps the id of a request currently being handled to the
+	// context.CancelFunc that aborts it, so a matching protocol.Cancel
+	// frame can actually cancel the handler goroutine instead of just
+	// being logged.
+	inFlight sync.Map
+
 	heartBeatPeriod time.Duration
 	collectPeriod   time.Duration
 }
 
+// pendingEntry tracks an in-flight Call. req is kept around so the call can
+// be replayed against a fresh connection after a reconnect.
+type pendingEntry struct {
+	req    *protocol.Message
+	respCh chan callResult
+	replay bool
+}
+
+type callResult struct {
+	msg *protocol.Message
+	err error
+}
+
 func (s *OperationServer) makeClient(id string, conn *websocket.Conn) *Client {
 	logger.Info("add client")
 	cli := &Client{
-		id:   id,
-		conn: conn,
+		id:         id,
+		conn:       conn,
+		hub:        s,
+		codec:      codecForSubprotocol(conn.Subprotocol()),
+		middleware: append([]Middleware(nil), s.middleware...),
 
 		pingCh:          make(chan []byte),
 		messageIn:       make(chan []byte),
-		messageOut:      make(chan []byte),
-		closeCh:         make(chan bool, 1),
+		outNormal:       make(chan []byte, defaultSendQueueSize),
+		outControl:      make(chan []byte, defaultControlQueueSize),
+		closeCh:         make(chan struct{}),
 		handler:         make(map[string]Handler),
 		maxPendingCalls: s.maxPendingCall,
 	}
@@ -60,18 +108,81 @@ func (s *OperationServer) makeClient(id string, conn *websocket.Conn) *Client {
 	return cli
 }
 
+// NewDialClient creates a Client that owns the outbound side of the
+// connection: Run dials url itself, reconnecting with backoff whenever the
+// connection drops, instead of being handed an already-accepted conn by an
+// OperationServer.
+func NewDialClient(url string, timeout protocol.TimeOutConfig, opts DialOptions) *Client {
+	opts.setDefaults()
+
+	cli := &Client{
+		id:      uuid.NewString(),
+		url:     url,
+		timeout: timeout,
+		dial:    &opts,
+		codec:   opts.Codec,
+
+		pingCh:     make(chan []byte),
+		messageIn:  make(chan []byte),
+		outNormal:  make(chan []byte, defaultSendQueueSize),
+		outControl: make(chan []byte, defaultControlQueueSize),
+		closeCh:    make(chan struct{}),
+		handler:    make(map[string]Handler),
+	}
+	cli.hub = cli
+
+	return cli
+}
+
 func (c *Client) getId() string {
 	return c.id
 }
 
+// markDone broadcasts that the connection is shutting down by closing
+// closeCh exactly once. Any number of goroutines can select on it without
+// racing to consume the signal.
+func (c *Client) markDone() {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+	})
+}
+
 func (c *Client) run() {
-	go c.readLoop(s)
-	go c.writeLoop()
+	go func() {
+		_ = c.serve()
+	}()
+}
+
+// serve runs the read/write loops to completion and reports the error that
+// ended them, if any. A nil error means the connection was closed normally.
+func (c *Client) serve() error {
+	c.lastErr = nil
+	c.closeCh = make(chan struct{})
+	c.closeOnce = sync.Once{}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		c.readLoop(c.hub)
+	}()
+	go func() {
+		defer wg.Done()
+		c.writeLoop()
+	}()
+
+	wg.Wait()
+	return c.lastErr
 }
 
 func (c *Client) readLoop(w WebSocketInstance) {
 
-	defer s.Remove(c.id)
+	defer func() {
+		if s, ok := w.(*OperationServer); ok {
+			s.Remove(c.id)
+		}
+	}()
 
 	for {
 		_, msg, err := c.conn.ReadMessage()
@@ -79,19 +190,21 @@ func (c *Client) readLoop(w WebSocketInstance) {
 
 		if err != nil {
 			logger.Error(err)
-			c.closeCh <- true
+			c.lastErr = err
+			c.markDone()
 			return
 		}
 
 		message, err := protocol.ToMessage(msg)
 		if err != nil {
 			logger.Error(err)
-			c.closeCh <- true
+			c.lastErr = err
+			c.markDone()
 			break
 		}
 
 		if message == nil {
-			c.closeCh <- true
+			c.markDone()
 			break
 		}
 
@@ -99,148 +212,179 @@ func (c *Client) readLoop(w WebSocketInstance) {
 			logger.Info("got resp message")
 			if call, ok := c.pendingCalls.Load(message.Id); ok {
 				logger.Info("got call")
-				if callCh, ok := call.(chan *protocol.Message); ok {
-					logger.Info("got call channel")
-					callCh <- message
+				if entry, ok := call.(*pendingEntry); ok {
+					entry.respCh <- callResult{msg: message}
 				}
 			}
 			continue
 		}
 
-		h := w.getHandler(message.Action)
-		if h == nil {
-			c.closeCh <- true
-			break
-		}
-
-		respData := h(c, message)
-		if respData == nil {
-			c.closeCh <- true
-			break
+		if message.Type == protocol.Stream {
+			logger.Info("got stream message")
+			if sub, ok := c.pendingSubs.Load(message.Id); ok {
+				sub.(*Subscription).deliver(message)
+			}
+			continue
 		}
 
-		resp := protocol.Message{
-			Id:     uuid.NewString(),
-			Type:   protocol.Resp,
-			Action: message.Action,
-			Data:   *respData,
+		if message.Type == protocol.Cancel {
+			logger.Info("got cancel message")
+			if cancel, ok := c.inFlight.Load(message.Id); ok {
+				cancel.(context.CancelFunc)()
+			}
+			continue
 		}
 
-		msgOut, err := resp.ToBytes()
-		if err != nil {
-			logger.Error(err)
-			c.closeCh <- true
-			return
+		h := w.getHandler(message.Action)
+		if h == nil {
+			c.markDone()
+			break
 		}
 
-		c.messageOut <- msgOut
-
+		c.dispatchAsync(h, message)
 	}
 
 }
 
-func (c *Client) writeLoop() {
+// dispatchAsync runs h in its own goroutine, off the read loop, so a
+// protocol.Cancel frame for a different request can still be read and acted
+// on while this one is in flight. The handler's context is cancelled if a
+// matching Cancel frame arrives via inFlight, or once the handler returns.
+func (c *Client) dispatchAsync(h Handler, message *protocol.Message) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.inFlight.Store(message.Id, cancel)
 
-	defer s.Remove(c.id)
+	go func() {
+		defer func() {
+			c.inFlight.Delete(message.Id)
+			cancel()
+		}()
 
-	for {
-
-		select {
-
-		case msg, ok := <-c.messageOut:
-			if !ok {
-				c.closeCh <- true
-				return
-			}
-
-			writer, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				logger.Error(err)
-				c.closeCh <- true
-				return
-			}
+		resp := c.dispatchCtx(ctx, Chain(h, c.middleware...), message)
 
-			_, err = writer.Write(msg)
-			if err != nil {
-				logger.Error(err)
-				c.closeCh <- true
-				return
-			}
-			logger.InfoF("send %s \nto %s", string(msg), c.id)
-
-		case <-c.pingCh:
-
-			err := c.conn.WriteMessage(websocket.PongMessage, []byte{})
-			if err != nil {
-				logger.Error(err)
-				c.closeCh <- true
-				return
-			}
-
-		case <-c.closeCh:
-
-			cm := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
-			err := c.conn.WriteMessage(websocket.CloseMessage, cm)
-			if err != nil {
-				logger.Error(err)
-				_ = c.conn.NetConn().Close()
-				break
-			}
+		msgOut, err := resp.ToBytes()
+		if err != nil {
+			logger.Error(err)
+			c.lastErr = err
+			c.markDone()
+			return
+		}
 
+		if err := c.enqueue(msgOut, PriorityNormal); err != nil {
+			logger.Error(err)
 		}
+	}()
+}
 
-	}
+func (c *Client) getHandler(action string) Handler {
+	return c.handler[action]
 }
 
-func (c *Client) Call(action string, data any) (*protocol.Message, error) {
+// Use appends middleware that wraps every handler invoked on this client,
+// closest-to-the-handler last. Call it before Run/the connection is
+// accepted; it is not safe to call concurrently with an active read loop.
+func (c *Client) Use(mw ...Middleware) {
+	c.middleware = append(c.middleware, mw...)
+}
 
-	if c.pendingCnt.Load() >= int32(c.maxPendingCalls) {
-		return nil, errors.New("max pending calls exceeded")
+// dispatchCtx runs h for message and turns its result into the protocol.Message
+// to send back: a protocol.Resp on success, a protocol.Err carrying a
+// HandlerError on failure.
+func (c *Client) dispatchCtx(ctx context.Context, h Handler, message *protocol.Message) protocol.Message {
+	respData, err := h(ctx, c, message)
+	if err != nil {
+		return protocol.Message{
+			Id:     uuid.NewString(),
+			Type:   protocol.Err,
+			Action: message.Action,
+			Data:   c.marshalHandlerError(err),
+		}
 	}
 
-	raw, err := json.Marshal(data)
-	if err != nil {
-		logger.Error(err)
-		return nil, err
+	raw, mErr := c.activeCodec().Marshal(respData)
+	if mErr != nil {
+		logger.Error(mErr)
+		raw = c.marshalHandlerError(NewHandlerError("internal", "failed to encode response", nil))
+		return protocol.Message{
+			Id:     uuid.NewString(),
+			Type:   protocol.Err,
+			Action: message.Action,
+			Data:   raw,
+		}
 	}
 
-	req := &protocol.Message{
+	return protocol.Message{
 		Id:     uuid.NewString(),
-		Type:   protocol.Req,
-		Action: action,
+		Type:   protocol.Resp,
+		Action: message.Action,
 		Data:   raw,
 	}
+}
 
-	respCh := make(chan *protocol.Message, 1)
-	c.pendingCalls.Store(req.Id, respCh)
-	c.pendingCnt.Add(1)
-	defer func() {
-		c.pendingCalls.Delete(req.Id)
-		c.pendingCnt.Add(-1)
-	}()
-
-	msgBytes, err := req.ToBytes()
-	if err != nil {
-		logger.Error(err)
-		return nil, err
+// marshalHandlerError encodes err as a HandlerError, wrapping plain errors
+// as an internal error so every protocol.Err frame has a code.
+func (c *Client) marshalHandlerError(err error) []byte {
+	herr, ok := err.(*HandlerError)
+	if !ok {
+		herr = NewHandlerError("internal", err.Error(), nil)
 	}
 
-	logger.Info(string(msgBytes))
+	raw, mErr := c.activeCodec().Marshal(herr)
+	if mErr != nil {
+		logger.Error(mErr)
+		return nil
+	}
+	return raw
+}
 
-	c.messageOut <- msgBytes
-	select {
+// activeCodec returns the client's negotiated Codec, defaulting to
+// JSONCodec for clients constructed before a codec was assigned.
+func (c *Client) activeCodec() Codec {
+	if c.codec == nil {
+		return JSONCodec{}
+	}
+	return c.codec
+}
 
-	case resp := <-respCh:
-		logger.InfoF("resp : %v", resp)
-		return resp, nil
+// Decode unmarshals raw message data with the client's negotiated codec, so
+// handlers aren't stuck assuming JSON.
+func (c *Client) Decode(data []byte, v any) error {
+	return c.activeCodec().Unmarshal(data, v)
+}
 
-	case <-time.After(c.timeout.ReadWait):
-		return nil, errors.New("timeout")
+// closeWithPolicyViolation tears down the connection with a policy-violation
+// close code, used when a subscriber configured with the Disconnect
+// slow-consumer policy falls behind.
+func (c *Client) closeWithPolicyViolation() {
+	logger.Error(errors.New("coms: slow consumer, closing with policy violation"))
+	c.closeCode = policyViolationCloseCode
+	c.markDone()
+}
 
-	}
+// failPendingCalls resolves every call still waiting on this connection: a
+// call marked Replay is re-queued for delivery on the next connection,
+// everything else fails immediately with ErrDisconnected.
+func (c *Client) failPendingCalls(cause error) {
+	c.pendingCalls.Range(func(key, value any) bool {
+		entry := value.(*pendingEntry)
+
+		if entry.replay {
+			if msgBytes, err := entry.req.ToBytes(); err == nil {
+				if err := c.enqueue(msgBytes, PriorityNormal); err != nil {
+					logger.Error(err)
+				}
+			}
+			return true
+		}
 
-}
+		select {
+		case entry.respCh <- callResult{err: ErrDisconnected}:
+		default:
+		}
+		c.pendingCalls.Delete(key)
+		c.pendingCnt.Add(-1)
 
-func (c *Client) getHandler(action string) Handler {
-	return c.handler[action]
+		_ = cause
+		return true
+	})
 }
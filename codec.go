@@ -0,0 +1,88 @@
+package coms
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec controls how protocol.Message payloads are marshalled on the wire
+// and which websocket frame type carries them. Client and OperationServer
+// negotiate a Codec during the handshake via the Sec-WebSocket-Protocol
+// header (see Subprotocol).
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	ContentType() string
+	WSMessageType() int
+}
+
+// Subprotocol returns the Sec-WebSocket-Protocol name a Codec negotiates the
+// handshake with, e.g. "coms.json.v1".
+func Subprotocol(c Codec) string {
+	switch c.ContentType() {
+	case "application/msgpack":
+		return "coms.msgpack.v1"
+	case "application/protobuf":
+		return "coms.protobuf.v1"
+	default:
+		return "coms.json.v1"
+	}
+}
+
+// codecForSubprotocol maps a negotiated Sec-WebSocket-Protocol value back to
+// the Codec that speaks it, defaulting to JSONCodec for an empty or
+// unrecognized subprotocol.
+func codecForSubprotocol(subprotocol string) Codec {
+	switch subprotocol {
+	case "coms.msgpack.v1":
+		return MsgpackCodec{}
+	case "coms.protobuf.v1":
+		return ProtobufCodec{}
+	default:
+		return JSONCodec{}
+	}
+}
+
+// JSONCodec is the default Codec and matches the wire format coms has
+// always used.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error)   { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(d []byte, v any) error { return json.Unmarshal(d, v) }
+func (JSONCodec) ContentType() string             { return "application/json" }
+func (JSONCodec) WSMessageType() int              { return websocket.TextMessage }
+
+// MsgpackCodec marshals payloads as MessagePack over binary frames.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(v any) ([]byte, error)   { return msgpack.Marshal(v) }
+func (MsgpackCodec) Unmarshal(d []byte, v any) error { return msgpack.Unmarshal(d, v) }
+func (MsgpackCodec) ContentType() string             { return "application/msgpack" }
+func (MsgpackCodec) WSMessageType() int              { return websocket.BinaryMessage }
+
+// ProtobufCodec marshals payloads as protobuf over binary frames. v must
+// implement proto.Message.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("coms: ProtobufCodec requires a proto.Message, got %T", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (ProtobufCodec) Unmarshal(d []byte, v any) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("coms: ProtobufCodec requires a proto.Message, got %T", v)
+	}
+	return proto.Unmarshal(d, msg)
+}
+
+func (ProtobufCodec) ContentType() string { return "application/protobuf" }
+func (ProtobufCodec) WSMessageType() int  { return websocket.BinaryMessage }
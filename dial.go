@@ -0,0 +1,142 @@
+package coms
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/seanlee0923/coms/logger"
+)
+
+// ErrDisconnected is delivered to any in-flight Call that was abandoned by a
+// connection drop and was not eligible for replay.
+var ErrDisconnected = errors.New("coms: client disconnected")
+
+// ErrNotDialing is returned by Run when called on a Client that wasn't
+// created with NewDialClient.
+var ErrNotDialing = errors.New("coms: Run called on a non-dialing client")
+
+// DialOptions configures the outbound connection managed by a Client created
+// with NewDialClient.
+type DialOptions struct {
+	// MinBackoff/MaxBackoff bound the exponential backoff used between
+	// reconnect attempts. Zero values fall back to 500ms/30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Header is sent with the dial handshake, e.g. for authentication.
+	Header http.Header
+
+	// Codec selects the wire format negotiated via Sec-WebSocket-Protocol.
+	// Defaults to JSONCodec.
+	Codec Codec
+
+	// OnConnect is called after every successful dial, including
+	// reconnects, so callers can (re-)register handlers and
+	// re-subscribe. OnDisconnect is called once the connection is lost,
+	// before a reconnect is attempted.
+	OnConnect    func(c *Client)
+	OnDisconnect func(c *Client, err error)
+}
+
+func (o *DialOptions) setDefaults() {
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.Codec == nil {
+		o.Codec = JSONCodec{}
+	}
+}
+
+// Run dials the client's url and services the connection until it is closed
+// normally, reconnecting with exponential backoff and jitter on any other
+// error. It blocks for the lifetime of the client.
+func (c *Client) Run() error {
+	if c.dial == nil {
+		return ErrNotDialing
+	}
+
+	backoff := c.dial.MinBackoff
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{Subprotocol(c.activeCodec())}
+
+	for {
+		conn, _, err := dialer.Dial(c.url, c.dial.Header)
+		if err != nil {
+			logger.Error(err)
+			time.Sleep(jitter(backoff))
+			backoff = nextBackoff(backoff, c.dial.MaxBackoff)
+			continue
+		}
+
+		c.conn = conn
+		c.connected = true
+		backoff = c.dial.MinBackoff
+
+		c.conn.SetPingHandler(func(appData string) error {
+			c.pingCh <- []byte(appData)
+			return c.conn.SetWriteDeadline(time.Now().Add(c.timeout.PingWait))
+		})
+
+		if c.dial.OnConnect != nil {
+			c.dial.OnConnect(c)
+		}
+
+		exitErr := c.serve()
+		c.connected = false
+
+		// Drain whatever the dead connection left queued before resolving
+		// pending work: failPendingCalls' replay branch re-enqueues calls for
+		// the *next* connection right after this, and those must survive.
+		c.drainQueues()
+		c.failPendingCalls(exitErr)
+		c.failPendingSubs(exitErr)
+
+		if c.dial.OnDisconnect != nil {
+			c.dial.OnDisconnect(c, exitErr)
+		}
+
+		if !shouldReconnect(exitErr) {
+			return nil
+		}
+
+		time.Sleep(jitter(backoff))
+		backoff = nextBackoff(backoff, c.dial.MaxBackoff)
+	}
+}
+
+// shouldReconnect reports whether Run should redial after the connection
+// ended with exitErr. nil (a local, intentional close) and an explicit
+// CloseNormalClosure frame from the peer both mean "stop"; everything else
+// — network drops, timeouts, a killed peer, or a non-1000 close code — means
+// reconnect. Most real-world disconnects (torn TCP, io.EOF, a crashed
+// server) surface as a plain error, not a *websocket.CloseError, so the
+// check must default to reconnecting rather than requiring a close frame.
+func shouldReconnect(exitErr error) bool {
+	if exitErr == nil {
+		return false
+	}
+	return !websocket.IsCloseError(exitErr, websocket.CloseNormalClosure)
+}
+
+func nextBackoff(cur, max time.Duration) time.Duration {
+	next := cur * 2
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// jitter returns d +/- 50%, so reconnecting peers don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
@@ -0,0 +1,110 @@
+package coms
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/seanlee0923/coms/protocol"
+)
+
+var errConnReset = errors.New("read: connection reset by peer")
+
+func TestShouldReconnect(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil error stops", nil, false},
+		{"normal closure stops", &websocket.CloseError{Code: websocket.CloseNormalClosure}, false},
+		{"going away reconnects", &websocket.CloseError{Code: websocket.CloseGoingAway}, true},
+		{"plain network error reconnects", errConnReset, true},
+		{"unexpected EOF reconnects", io.ErrUnexpectedEOF, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := shouldReconnect(tc.err); got != tc.want {
+				t.Errorf("shouldReconnect(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	if got := nextBackoff(time.Second, 30*time.Second); got != 2*time.Second {
+		t.Errorf("nextBackoff(1s, 30s) = %v, want 2s", got)
+	}
+	if got := nextBackoff(20*time.Second, 30*time.Second); got != 30*time.Second {
+		t.Errorf("nextBackoff(20s, 30s) = %v, want capped at 30s", got)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := 10 * time.Second
+	for i := 0; i < 100; i++ {
+		j := jitter(d)
+		if j < d/2 || j >= 3*d/2 {
+			t.Fatalf("jitter(%v) = %v, want in [%v, %v)", d, j, d/2, 3*d/2)
+		}
+	}
+	if jitter(0) != 0 {
+		t.Errorf("jitter(0) = %v, want 0", jitter(0))
+	}
+}
+
+// TestRun_ReconnectsOnDroppedConnection simulates a crashed peer: the first
+// connection is torn down without a close frame, which previously made
+// shouldReconnect's inverted check give up for good. Run must dial again.
+func TestRun_ReconnectsOnDroppedConnection(t *testing.T) {
+	var attempts int32
+	upgrader := websocket.Upgrader{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// Simulate a crash/dropped TCP connection: no close frame.
+			_ = conn.Close()
+			return
+		}
+
+		// Second connection: close it normally so Run returns cleanly.
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		_ = conn.Close()
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	c := NewDialClient(url, protocol.TimeOutConfig{ReadWait: time.Second, PingWait: time.Second}, DialOptions{
+		MinBackoff: 5 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run never returned; it likely failed to reconnect after the dropped connection")
+	}
+
+	if n := atomic.LoadInt32(&attempts); n < 2 {
+		t.Fatalf("expected at least 2 connection attempts, got %d", n)
+	}
+}
@@ -0,0 +1,104 @@
+package coms
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/seanlee0923/coms/logger"
+	"github.com/seanlee0923/coms/protocol"
+	"golang.org/x/time/rate"
+)
+
+// HandlerError is the structured error a Handler returns when it wants
+// control over the code/message/details sent back to the peer in a
+// protocol.Err frame. A plain error is wrapped as an "internal" HandlerError.
+type HandlerError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+func (e *HandlerError) Error() string {
+	return e.Message
+}
+
+// NewHandlerError builds a HandlerError for a Handler to return.
+func NewHandlerError(code, message string, details any) *HandlerError {
+	return &HandlerError{Code: code, Message: message, Details: details}
+}
+
+// Middleware wraps a Handler, mirroring net/http's middleware shape.
+type Middleware func(Handler) Handler
+
+// Chain applies mws around h, with mws[0] outermost and h innermost.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Use registers middleware that wraps every handler invoked by clients this
+// server accepts from this point on; existing clients are unaffected.
+func (s *OperationServer) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+// Recover turns a panic inside a handler into an "internal" HandlerError
+// instead of killing the read loop.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, c *Client, m *protocol.Message) (resp any, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error(fmt.Errorf("coms: handler panic: %v", r))
+					resp, err = nil, NewHandlerError("internal", "internal error", nil)
+				}
+			}()
+			return next(ctx, c, m)
+		}
+	}
+}
+
+// Logging logs every handler invocation with client id, action, message id
+// and duration.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, c *Client, m *protocol.Message) (any, error) {
+			start := time.Now()
+			resp, err := next(ctx, c, m)
+			logger.InfoF("client=%s action=%s id=%s duration=%s err=%v", c.id, m.Action, m.Id, time.Since(start), err)
+			return resp, err
+		}
+	}
+}
+
+// RateLimit applies a per-action token bucket, sharing one rate.Limiter per
+// action across every client the middleware is installed on.
+func RateLimit(r rate.Limit, burst int) Middleware {
+	var mu sync.Mutex
+	limiters := make(map[string]*rate.Limiter)
+
+	limiterFor := func(action string) *rate.Limiter {
+		mu.Lock()
+		defer mu.Unlock()
+
+		l, ok := limiters[action]
+		if !ok {
+			l = rate.NewLimiter(r, burst)
+			limiters[action] = l
+		}
+		return l
+	}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, c *Client, m *protocol.Message) (any, error) {
+			if !limiterFor(m.Action).Allow() {
+				return nil, NewHandlerError("rate_limited", "rate limit exceeded", nil)
+			}
+			return next(ctx, c, m)
+		}
+	}
+}
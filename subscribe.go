@@ -0,0 +1,205 @@
+package coms
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/seanlee0923/coms/logger"
+	"github.com/seanlee0923/coms/protocol"
+)
+
+// ErrSlowConsumer is recorded on a Subscription that was closed because it
+// fell behind under the Disconnect slow-consumer policy.
+var ErrSlowConsumer = errors.New("coms: slow consumer, subscription closed")
+
+// policyViolationCloseCode is sent when a slow subscriber triggers the
+// Disconnect slow-consumer policy (1008, the standard policy-violation code).
+const policyViolationCloseCode = websocket.ClosePolicyViolation
+
+const defaultSubscriptionBuffer = 32
+
+// SlowConsumerPolicy controls what happens when a Subscription's buffer
+// fills up faster than the caller drains Messages().
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest buffered frame to make room for the
+	// incoming one.
+	DropOldest SlowConsumerPolicy = iota
+	// Disconnect closes the connection with a policy-violation close code.
+	Disconnect
+)
+
+// SubscribeOption customizes a single Subscribe call.
+type SubscribeOption func(*subscribeConfig)
+
+type subscribeConfig struct {
+	buffer int
+	policy SlowConsumerPolicy
+}
+
+// WithBuffer overrides the default buffered channel size backing a
+// Subscription.
+func WithBuffer(n int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.buffer = n
+	}
+}
+
+// WithSlowConsumerPolicy overrides the default DropOldest policy applied
+// when the subscriber can't keep up.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.policy = p
+	}
+}
+
+// Subscription is a long-lived, server-initiated stream of responses to a
+// single Subscribe call, sharing a request id across every frame.
+type Subscription struct {
+	id     string
+	client *Client
+	policy SlowConsumerPolicy
+
+	msgCh chan *protocol.Message
+	errCh chan error
+
+	closeOnce sync.Once
+}
+
+// Messages returns the channel frames are delivered on. It is closed once
+// the subscription receives a Final frame or is Close'd.
+func (s *Subscription) Messages() <-chan *protocol.Message {
+	return s.msgCh
+}
+
+// Err returns the error that ended the subscription, if any, after
+// Messages() has been drained and closed. It is safe to call at any time.
+func (s *Subscription) Err() error {
+	select {
+	case err := <-s.errCh:
+		// Put the error back so later calls report it too.
+		select {
+		case s.errCh <- err:
+		default:
+		}
+		return err
+	default:
+		return nil
+	}
+}
+
+// Close unregisters the subscription so no further frames are routed to it.
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.client.pendingSubs.Delete(s.id)
+		close(s.msgCh)
+	})
+	return nil
+}
+
+// deliver routes an incoming protocol.Stream frame to the subscriber,
+// applying the configured slow-consumer policy if the buffer is full.
+func (s *Subscription) deliver(msg *protocol.Message) {
+	select {
+	case s.msgCh <- msg:
+	default:
+		switch s.policy {
+		case DropOldest:
+			select {
+			case <-s.msgCh:
+			default:
+			}
+			select {
+			case s.msgCh <- msg:
+			default:
+			}
+		case Disconnect:
+			s.fail(ErrSlowConsumer)
+			s.client.closeWithPolicyViolation()
+			return
+		}
+	}
+
+	if msg.Final {
+		_ = s.Close()
+	}
+}
+
+func (s *Subscription) fail(err error) {
+	select {
+	case s.errCh <- err:
+	default:
+	}
+	_ = s.Close()
+}
+
+// failPendingSubs resolves every subscription still registered on this
+// connection, mirroring failPendingCalls: left alone, a live Subscription's
+// Messages() channel would never close and Err() would never be set after a
+// reconnect, since stream frames for its request id can never arrive on the
+// new connection.
+func (c *Client) failPendingSubs(cause error) {
+	if cause == nil {
+		cause = ErrDisconnected
+	}
+	c.pendingSubs.Range(func(_, value any) bool {
+		value.(*Subscription).fail(cause)
+		return true
+	})
+}
+
+// Subscribe sends a request for action and returns a Subscription that
+// receives every protocol.Stream frame the peer pushes back under the same
+// request id, until one arrives with Final set.
+func (c *Client) Subscribe(action string, data any, opts ...SubscribeOption) (*Subscription, error) {
+	cfg := subscribeConfig{buffer: defaultSubscriptionBuffer, policy: DropOldest}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	raw, err := c.activeCodec().Marshal(data)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
+	req := &protocol.Message{
+		Id:     uuid.NewString(),
+		Type:   protocol.Req,
+		Action: action,
+		Data:   raw,
+	}
+
+	sub := &Subscription{
+		id:     req.Id,
+		client: c,
+		policy: cfg.policy,
+		msgCh:  make(chan *protocol.Message, cfg.buffer),
+		errCh:  make(chan error, 1),
+	}
+	c.pendingSubs.Store(req.Id, sub)
+
+	msgBytes, err := req.ToBytes()
+	if err != nil {
+		logger.Error(err)
+		c.pendingSubs.Delete(req.Id)
+		return nil, err
+	}
+
+	select {
+	case <-c.closeCh:
+		c.pendingSubs.Delete(req.Id)
+		return nil, ErrDisconnected
+	default:
+	}
+
+	if err := c.enqueue(msgBytes, PriorityNormal); err != nil {
+		c.pendingSubs.Delete(req.Id)
+		return nil, err
+	}
+
+	return sub, nil
+}
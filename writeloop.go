@@ -0,0 +1,196 @@
+package coms
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/seanlee0923/coms/logger"
+)
+
+const (
+	// pingPeriod is how often writeLoop actively pings the peer.
+	pingPeriod = 30 * time.Second
+	// writeWait bounds every write to the connection, including pings and
+	// the close handshake, so a stuck peer can't hang the write loop.
+	writeWait = 10 * time.Second
+
+	defaultSendQueueSize    = 256
+	defaultControlQueueSize = 16
+)
+
+// sendPriority orders a frame in the outbound queue. Control-priority frames
+// (such as cancel) are served ahead of whatever normal traffic is backlogged.
+type sendPriority int
+
+const (
+	PriorityNormal sendPriority = iota
+	PriorityControl
+)
+
+// ErrSendQueueFull is returned by enqueue when the outbound queue for the
+// requested priority is full, instead of blocking the caller forever.
+var ErrSendQueueFull = errors.New("coms: send queue full")
+
+// enqueue hands msg to writeLoop without blocking the caller.
+func (c *Client) enqueue(msg []byte, priority sendPriority) error {
+	ch := c.outNormal
+	if priority == PriorityControl {
+		ch = c.outControl
+	}
+
+	select {
+	case ch <- msg:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// drainQueues discards anything left in outNormal/outControl from a
+// previous connection. Without this, a message enqueued but not yet flushed
+// when the connection dropped would sit in the channel and get silently
+// written to the *next* connection by writeLoop, even though the request it
+// belonged to was already failed (see failPendingCalls/failPendingSubs) and
+// the caller has moved on.
+func (c *Client) drainQueues() {
+	for {
+		select {
+		case <-c.outNormal:
+		case <-c.outControl:
+		default:
+			return
+		}
+	}
+}
+
+// writeLoop owns the connection: it's the only goroutine that ever writes
+// to c.conn. It drains outControl ahead of outNormal, answers peer pings,
+// actively pings the peer every pingPeriod, and tears the connection down
+// on markDone.
+func (c *Client) writeLoop() {
+
+	defer func() {
+		if s, ok := c.hub.(*OperationServer); ok {
+			s.Remove(c.id)
+		}
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		// Serve any queued control frame before waiting on the rest, so a
+		// backlog in outNormal can't hold it back.
+		select {
+		case msg := <-c.outControl:
+			if !c.writeFrame(msg) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+
+		case msg := <-c.outControl:
+			if !c.writeFrame(msg) {
+				return
+			}
+
+		case msg := <-c.outNormal:
+			if !c.writeFrame(msg) {
+				return
+			}
+
+		case <-c.pingCh:
+			if !c.writeControl(websocket.PongMessage, nil) {
+				return
+			}
+
+		case <-ticker.C:
+			if !c.writeControl(websocket.PingMessage, nil) {
+				return
+			}
+
+		case <-c.closeCh:
+			code := c.closeCode
+			if code == 0 {
+				code = websocket.CloseNormalClosure
+			}
+			cm := websocket.FormatCloseMessage(code, "")
+
+			// If readLoop already recorded why we're closing (e.g. the
+			// peer's own close frame, which gorilla's default CloseHandler
+			// already echoed a reply to from inside ReadMessage), our own
+			// reply here is redundant and will fail with ErrCloseSent.
+			// Don't let that clobber the real reason with a spurious one.
+			priorErr := c.lastErr
+			ok := c.writeControl(websocket.CloseMessage, cm)
+			if priorErr != nil {
+				c.lastErr = priorErr
+			}
+			if !ok {
+				_ = c.conn.NetConn().Close()
+			}
+			return
+
+		}
+	}
+}
+
+// writeFrame writes msg as a single frame in the client's negotiated codec,
+// always setting a write deadline first.
+func (c *Client) writeFrame(msg []byte) bool {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		logger.Error(err)
+		c.lastErr = err
+		c.markDone()
+		return false
+	}
+
+	writer, err := c.conn.NextWriter(c.activeCodec().WSMessageType())
+	if err != nil {
+		logger.Error(err)
+		c.lastErr = err
+		c.markDone()
+		return false
+	}
+
+	if _, err := writer.Write(msg); err != nil {
+		logger.Error(err)
+		c.lastErr = err
+		c.markDone()
+		return false
+	}
+
+	if err := writer.Close(); err != nil {
+		logger.Error(err)
+		c.lastErr = err
+		c.markDone()
+		return false
+	}
+
+	logger.InfoF("send %s \nto %s", string(msg), c.id)
+	return true
+}
+
+// writeControl writes a single control frame (ping/pong/close), always
+// setting a write deadline first.
+func (c *Client) writeControl(msgType int, data []byte) bool {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		logger.Error(err)
+		c.lastErr = err
+		c.markDone()
+		return false
+	}
+
+	if err := c.conn.WriteMessage(msgType, data); err != nil {
+		logger.Error(err)
+		c.lastErr = err
+		c.markDone()
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,58 @@
+package coms
+
+import "testing"
+
+func TestEnqueue(t *testing.T) {
+	c := &Client{
+		outNormal:  make(chan []byte, 1),
+		outControl: make(chan []byte, 1),
+	}
+
+	if err := c.enqueue([]byte("normal"), PriorityNormal); err != nil {
+		t.Fatalf("enqueue(normal) = %v, want nil", err)
+	}
+	if err := c.enqueue([]byte("overflow"), PriorityNormal); err != ErrSendQueueFull {
+		t.Fatalf("enqueue into full outNormal = %v, want ErrSendQueueFull", err)
+	}
+
+	if err := c.enqueue([]byte("control"), PriorityControl); err != nil {
+		t.Fatalf("enqueue(control) = %v, want nil", err)
+	}
+	if err := c.enqueue([]byte("overflow"), PriorityControl); err != ErrSendQueueFull {
+		t.Fatalf("enqueue into full outControl = %v, want ErrSendQueueFull", err)
+	}
+}
+
+// TestDrainQueues proves stale frames enqueued on a dead connection don't
+// survive into the next one: left undrained, writeLoop would silently flush
+// them to the new connection after failPendingCalls already gave up on them.
+func TestDrainQueues(t *testing.T) {
+	c := &Client{
+		outNormal:  make(chan []byte, 4),
+		outControl: make(chan []byte, 4),
+	}
+
+	if err := c.enqueue([]byte("stale-normal"), PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.enqueue([]byte("stale-control"), PriorityControl); err != nil {
+		t.Fatal(err)
+	}
+
+	c.drainQueues()
+
+	select {
+	case msg := <-c.outNormal:
+		t.Fatalf("outNormal not drained, still has %q", msg)
+	default:
+	}
+	select {
+	case msg := <-c.outControl:
+		t.Fatalf("outControl not drained, still has %q", msg)
+	default:
+	}
+
+	if err := c.enqueue([]byte("fresh"), PriorityNormal); err != nil {
+		t.Fatalf("enqueue after drain = %v, want nil", err)
+	}
+}